@@ -0,0 +1,160 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/shared/mlog"
+	"github.com/mattermost/morph/models"
+)
+
+// migrationCallbacksMu guards migrationCallbacksByVersion.
+var migrationCallbacksMu sync.Mutex
+
+// migrationCallbackKey identifies a single migration within a single
+// MigrationScope's stream. Prefix (MigrationScope.Prefix) is part of
+// the key, not just Version, because two independent scopes (see
+// migration_scope.go) have their own embedded migration sets and can
+// legitimately reuse the same version number for unrelated migrations;
+// keying on Version alone would let one scope's callback silently
+// overwrite or fire for another's.
+type migrationCallbackKey struct {
+	Prefix  string
+	Version uint32
+}
+
+// migrationCallbacksByVersion holds the callbacks registered via
+// RegisterMigrationCallback/RegisterMigrationCallbackForScope, keyed by
+// scope and migration version. It's process-global rather than a field
+// on SQLStore because migration callbacks are tied to the embedded
+// migration set itself, which is shared by every SQLStore instance in a
+// process, not to any particular store's configuration.
+var migrationCallbacksByVersion = map[migrationCallbackKey]MigrationCallbacks{}
+
+// MigrationCallbacks lets a consumer hook into the lifecycle of a
+// single migration to perform in-Go data transforms (rewriting board
+// block JSON payloads, recomputing derived indexes, populating new
+// columns from external sources, etc.) that are painful to express as
+// raw SQL. Each callback runs inside the same transaction as the
+// migration it's attached to, where the underlying driver supports it,
+// so a failure in either rolls back the other.
+type MigrationCallbacks interface {
+	// BeforeUp runs immediately before an up migration is applied.
+	BeforeUp(migration *models.Migration, tx *sql.Tx) error
+	// AfterUp runs immediately after an up migration is applied.
+	AfterUp(migration *models.Migration, tx *sql.Tx) error
+	// BeforeDown runs immediately before a down migration is applied.
+	BeforeDown(migration *models.Migration, tx *sql.Tx) error
+	// AfterDown runs immediately after a down migration is applied.
+	AfterDown(migration *models.Migration, tx *sql.Tx) error
+}
+
+// RegisterMigrationCallback associates cb with the migration
+// identified by version in SQLStore's own (default) migration scope, so
+// it runs around that migration the next time this package applies it
+// (as an expand/contract phase or an out-of-order gap migration, see
+// runMigrationCallbacks). Migrations applied by the regular morph
+// engine run do not invoke registered callbacks. Registering
+// a second callback for the same version replaces the first; only one
+// callback per version is supported, matching the one-migration-one-
+// purpose shape of the embedded migration files themselves.
+func (s *SQLStore) RegisterMigrationCallback(version uint32, cb MigrationCallbacks) {
+	s.RegisterMigrationCallbackForScope(s.DefaultMigrationScope(), version, cb)
+}
+
+// RegisterMigrationCallbackForScope is RegisterMigrationCallback
+// parameterized by scope, for callers driving a MigrationScope other
+// than SQLStore's own default one, so their callback registrations
+// can't collide with another scope that happens to reuse the same
+// version number.
+func (s *SQLStore) RegisterMigrationCallbackForScope(scope MigrationScope, version uint32, cb MigrationCallbacks) {
+	migrationCallbacksMu.Lock()
+	defer migrationCallbacksMu.Unlock()
+	migrationCallbacksByVersion[migrationCallbackKey{Prefix: scope.Prefix, Version: version}] = cb
+}
+
+// runMigrationCallbacks invokes the callback registered for migration
+// in SQLStore's own (default) migration scope, if any, calling the
+// before/after pair that matches
+// direction. alreadyApplied lets the caller skip Go-side data
+// transforms that have already run, using whatever bookkeeping table
+// is authoritative for that caller: applyMigration (migration_pending.go)
+// checks schema_migrations, while applyMigrationPhase
+// (migration_expand_contract.go) has nothing to check against
+// schema_migrations and instead relies on the active-migration-state
+// guards in StartMigration/CompleteMigration/RollbackMigration to
+// prevent a phase from being re-applied.
+//
+// It's called around every migration this package itself applies (the
+// expand/contract phases in migration_expand_contract.go and the
+// out-of-order gap migrations applied by CheckMigrationGaps), wrapped
+// in the same transaction as the migration's DDL.
+func (s *SQLStore) runMigrationCallbacks(migration *models.Migration, tx *sql.Tx, before bool, alreadyApplied bool) error {
+	migrationCallbacksMu.Lock()
+	cb, ok := migrationCallbacksByVersion[migrationCallbackKey{Prefix: s.tablePrefix, Version: migration.Version}]
+	migrationCallbacksMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if alreadyApplied {
+		return nil
+	}
+
+	var callbackErr error
+	switch {
+	case before && migration.Direction == models.Up:
+		callbackErr = cb.BeforeUp(migration, tx)
+	case !before && migration.Direction == models.Up:
+		callbackErr = cb.AfterUp(migration, tx)
+	case before && migration.Direction == models.Down:
+		callbackErr = cb.BeforeDown(migration, tx)
+	case !before && migration.Direction == models.Down:
+		callbackErr = cb.AfterDown(migration, tx)
+	}
+
+	if callbackErr != nil {
+		s.logger.Error("migration callback failed", mlog.Uint32("version", migration.Version), mlog.Err(callbackErr))
+		return fmt.Errorf("migration callback for version %d failed: %w", migration.Version, callbackErr)
+	}
+
+	return nil
+}
+
+func (s *SQLStore) migrationVersionApplied(version uint32) (bool, error) {
+	query := s.getQueryBuilder(s.db).
+		Select("count(*)").
+		From(s.tablePrefix + "schema_migrations").
+		Where(sq.Eq{"Version": version})
+
+	row := query.QueryRow()
+
+	var count int
+	if err := row.Scan(&count); err != nil {
+		s.logger.Error("failed to check whether migration version was already applied", mlog.Uint32("version", version), mlog.Err(err))
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// orderedCallbackVersions returns the versions that have a registered
+// callback in SQLStore's own (default) migration scope, sorted
+// ascending, so callers that need to walk them in migration order
+// (rather than map iteration order) can do so.
+func (s *SQLStore) orderedCallbackVersions() []uint32 {
+	migrationCallbacksMu.Lock()
+	defer migrationCallbacksMu.Unlock()
+
+	versions := make([]uint32, 0, len(migrationCallbacksByVersion))
+	for key := range migrationCallbacksByVersion {
+		if key.Prefix == s.tablePrefix {
+			versions = append(versions, key.Version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
@@ -0,0 +1,352 @@
+package sqlstore
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/focalboard/server/model"
+	"github.com/mattermost/mattermost-server/v6/shared/mlog"
+	"github.com/mattermost/morph/models"
+)
+
+// migrationStateTableName holds the name (without prefix) of the table
+// used to track the single in-progress expand/contract migration, if
+// any. A row only exists here while a migration is between `start` and
+// `complete`/`rollback`.
+const migrationStateTableName = "migration_state"
+
+// migrationPhase identifies which of the three SQL files belonging to
+// an expand/contract migration should be applied.
+type migrationPhase string
+
+const (
+	// migrationPhaseStart creates the new columns/tables and any
+	// backfill triggers, leaving the old shape in place so that an
+	// old server binary keeps working untouched.
+	migrationPhaseStart migrationPhase = "start"
+	// migrationPhaseComplete drops the old columns/tables once every
+	// server has been upgraded to a version that only uses the new
+	// shape.
+	migrationPhaseComplete migrationPhase = "complete"
+	// migrationPhaseRollback drops the artifacts created by start
+	// without ever having completed, restoring the pre-migration
+	// state.
+	migrationPhaseRollback migrationPhase = "rollback"
+)
+
+// migrationState is the row persisted in migration_state while a
+// migration is in progress. Only one row can exist at a time; the
+// table's primary key is fixed to enforce that and give us linear
+// history instead of a stack of concurrent migrations.
+type migrationState struct {
+	Version uint32
+	Phase   migrationPhase
+}
+
+// StartMigration begins the expand phase of an expand/contract
+// migration for version. It applies the migration's `start` SQL file,
+// which is expected to only add new schema objects (columns, tables,
+// backfill triggers) so that the currently running server keeps
+// working against the old, untouched objects.
+//
+// Only one expand/contract migration can be active at a time; calling
+// StartMigration while another one is in progress returns an error.
+//
+// This is the expand half of the pgroll-style flow described in the
+// feature request. Scope actually delivered here, in this package: the
+// migration_state-backed phase state machine (this method,
+// CompleteMigration, RollbackMigration), transactional phase
+// application, and RunMigrationPhase below as the thin dispatch a CLI
+// command would call. Deliberately out of scope for this change,
+// because neither lives in this package: the `focalboard migrate` CLI
+// command itself (belongs in the server's cmd/ entry point, which
+// isn't part of this tree) and a concrete versioned-view migration pair
+// (e.g. focalboard_v{N-1}_blocks/focalboard_v{N}_blocks, which would be
+// embedded migration SQL files, not Go). Until a CLI and at least one
+// view-based migration are added, a `start` file still has to leave the
+// old shape queryable on its own (e.g. via a trigger or a generated
+// column) for this to be safe to run against a live server.
+func (s *SQLStore) StartMigration(version uint32) error {
+	if err := s.createMigrationStateTable(); err != nil {
+		return err
+	}
+
+	active, err := s.activeMigration()
+	if err != nil {
+		return err
+	}
+	if active != nil {
+		return fmt.Errorf("migration %d is already in progress (phase %s); complete or roll it back before starting another", active.Version, active.Phase)
+	}
+
+	if err := s.applyMigrationPhase(version, migrationPhaseStart, func(tx *sql.Tx) error {
+		return s.insertMigrationStateTx(tx, version, migrationPhaseStart)
+	}); err != nil {
+		return err
+	}
+
+	s.logger.Info("Started expand/contract migration", mlog.Uint32("version", version))
+
+	return nil
+}
+
+// CompleteMigration finishes an in-progress expand/contract migration
+// for version by applying its `complete` SQL file, which drops the old
+// columns/tables kept around since StartMigration. It fails if version
+// is not the currently active migration.
+func (s *SQLStore) CompleteMigration(version uint32) error {
+	if err := s.assertActiveMigration(version); err != nil {
+		return err
+	}
+
+	if err := s.applyMigrationPhase(version, migrationPhaseComplete, func(tx *sql.Tx) error {
+		return s.deleteMigrationStateTx(tx, version)
+	}); err != nil {
+		return err
+	}
+
+	s.logger.Info("Completed expand/contract migration", mlog.Uint32("version", version))
+
+	return nil
+}
+
+// RollbackMigration aborts an in-progress expand/contract migration
+// for version by applying its `rollback` SQL file, which drops
+// whatever StartMigration created, leaving the schema as it was before
+// the migration began. It fails if version is not the currently active
+// migration.
+func (s *SQLStore) RollbackMigration(version uint32) error {
+	if err := s.assertActiveMigration(version); err != nil {
+		return err
+	}
+
+	if err := s.applyMigrationPhase(version, migrationPhaseRollback, func(tx *sql.Tx) error {
+		return s.deleteMigrationStateTx(tx, version)
+	}); err != nil {
+		return err
+	}
+
+	s.logger.Info("Rolled back expand/contract migration", mlog.Uint32("version", version))
+
+	return nil
+}
+
+// RunMigrationPhase dispatches to StartMigration, CompleteMigration or
+// RollbackMigration by phase name ("start", "complete" or "rollback"),
+// so a `focalboard migrate {start,complete,rollback}` CLI command can
+// be a thin wrapper that parses its phase argument and version flag
+// and calls this, without duplicating the dispatch logic itself.
+func (s *SQLStore) RunMigrationPhase(phase string, version uint32) error {
+	switch migrationPhase(phase) {
+	case migrationPhaseStart:
+		return s.StartMigration(version)
+	case migrationPhaseComplete:
+		return s.CompleteMigration(version)
+	case migrationPhaseRollback:
+		return s.RollbackMigration(version)
+	default:
+		return fmt.Errorf("unknown migration phase %q: expected one of start, complete, rollback", phase)
+	}
+}
+
+func (s *SQLStore) assertActiveMigration(version uint32) error {
+	active, err := s.activeMigration()
+	if err != nil {
+		return err
+	}
+	if active == nil {
+		return fmt.Errorf("no expand/contract migration is in progress")
+	}
+	if active.Version != version {
+		return fmt.Errorf("migration %d is in progress, not %d", active.Version, version)
+	}
+	return nil
+}
+
+// applyMigrationPhase looks up the embedded migration file for version
+// carrying the given phase suffix (e.g. 000042_add_column.start.up.sql)
+// and executes its contents directly against the database, outside of
+// the regular morph engine run. recordState is called with the same
+// transaction to insert or delete the migration_state row that tracks
+// the phase, so a crash between applying the DDL and updating that
+// row is impossible: either both happen, or neither does, and a retry
+// after a failure re-applies the phase from a consistent starting
+// point rather than skipping straight to bookkeeping a phase that
+// never ran.
+//
+// Any callback registered for version via RegisterMigrationCallback
+// runs in the same transaction, before and after the phase's SQL.
+// start and complete are treated as an up migration for callback
+// purposes, rollback as a down migration.
+func (s *SQLStore) applyMigrationPhase(version uint32, phase migrationPhase, recordState func(tx *sql.Tx) error) error {
+	name, contents, err := s.readMigrationPhaseAsset(version, phase)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Debug("Applying expand/contract migration phase", mlog.Uint32("version", version), mlog.String("phase", string(phase)), mlog.String("file", name))
+
+	migration, err := models.NewMigration(io.NopCloser(&bytes.Buffer{}), name)
+	if err != nil {
+		return err
+	}
+	if phase == migrationPhaseRollback {
+		migration.Direction = models.Down
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for %s phase of migration %d: %w", phase, version, err)
+	}
+
+	// The active-migration-state guards in StartMigration/
+	// CompleteMigration/RollbackMigration already make sure this phase
+	// hasn't been (and isn't being) re-applied, so there's no separate
+	// "already applied" table to check here.
+	if err := s.runMigrationCallbacks(migration, tx, true, false); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(contents); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to apply %s phase of migration %d: %w", phase, version, err)
+	}
+
+	if err := recordState(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := s.runMigrationCallbacks(migration, tx, false, false); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %s phase of migration %d: %w", phase, version, err)
+	}
+
+	return nil
+}
+
+// readMigrationPhaseAsset finds the embedded migration asset for
+// version whose name contains the requested phase (e.g. ".start.",
+// ".complete." or ".rollback.") and returns its name and contents.
+func (s *SQLStore) readMigrationPhaseAsset(version uint32, phase migrationPhase) (string, string, error) {
+	assetsList, err := Assets.ReadDir("migrations")
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix := fmt.Sprintf("%06d_", version)
+	suffix := fmt.Sprintf(".%s.up.sql", phase)
+
+	for _, f := range assetsList {
+		name := f.Name()
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+			data, err := Assets.ReadFile("migrations/" + name)
+			if err != nil {
+				return "", "", err
+			}
+			return name, string(data), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("no %s phase file found for migration %d", phase, version)
+}
+
+func (s *SQLStore) createMigrationStateTable() error {
+	// squirrel doesn't support DDL, so this stays a plain string like
+	// the other schema bootstrap queries in this package. The ID
+	// column, always 1, being the primary key of a single-row table is
+	// what enforces "only one active migration at a time".
+	query := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (ID int NOT NULL DEFAULT 1, Version bigint NOT NULL, Phase varchar(16) NOT NULL, PRIMARY KEY (ID), CONSTRAINT %ssingle_active_migration CHECK (ID = 1))",
+		s.tablePrefix+migrationStateTableName,
+		s.tablePrefix,
+	)
+
+	// SQLite doesn't support naming CHECK constraints the same way;
+	// the single row is still enforced by ID being the primary key.
+	if s.dbType == model.SqliteDBType {
+		query = fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s (ID int NOT NULL DEFAULT 1, Version bigint NOT NULL, Phase varchar(16) NOT NULL, PRIMARY KEY (ID))",
+			s.tablePrefix+migrationStateTableName,
+		)
+	}
+
+	if _, err := s.db.Exec(query); err != nil {
+		s.logger.Error("failed to create migration state table", mlog.Err(err))
+		return err
+	}
+
+	return nil
+}
+
+func (s *SQLStore) activeMigration() (*migrationState, error) {
+	query := s.getQueryBuilder(s.db).
+		Select("Version", "Phase").
+		From(s.tablePrefix + migrationStateTableName).
+		Where(sq.Eq{"ID": 1})
+
+	row := query.QueryRow()
+
+	var state migrationState
+	if err := row.Scan(&state.Version, &state.Phase); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		s.logger.Error("failed to fetch active migration state", mlog.Err(err))
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// insertMigrationStateTx records the active migration's phase inside
+// tx, so it can be committed or rolled back together with the phase's
+// DDL by applyMigrationPhase.
+func (s *SQLStore) insertMigrationStateTx(tx *sql.Tx, version uint32, phase migrationPhase) error {
+	query := s.getQueryBuilder(s.db).
+		Insert(s.tablePrefix+migrationStateTableName).
+		Columns("ID", "Version", "Phase").
+		Values(1, version, string(phase))
+
+	sqlStr, args, err := query.ToSql()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(sqlStr, args...); err != nil {
+		s.logger.Error("failed to record active migration state", mlog.Err(err))
+		return err
+	}
+
+	return nil
+}
+
+// deleteMigrationStateTx is the tx-scoped counterpart to
+// insertMigrationStateTx, used by CompleteMigration and
+// RollbackMigration for the same reason.
+func (s *SQLStore) deleteMigrationStateTx(tx *sql.Tx, version uint32) error {
+	query := s.getQueryBuilder(s.db).
+		Delete(s.tablePrefix + migrationStateTableName).
+		Where(sq.Eq{"ID": 1, "Version": version})
+
+	sqlStr, args, err := query.ToSql()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(sqlStr, args...); err != nil {
+		s.logger.Error("failed to clear migration state", mlog.Err(err))
+		return err
+	}
+
+	return nil
+}
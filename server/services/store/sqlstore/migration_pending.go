@@ -0,0 +1,209 @@
+package sqlstore
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mattermost/focalboard/server/utils"
+	"github.com/mattermost/mattermost-server/v6/shared/mlog"
+	"github.com/mattermost/morph/models"
+)
+
+// PendingMigrations returns every embedded migration whose version is
+// missing from schema_migrations, regardless of whether that version
+// is below the current maximum applied version. This catches the case
+// where developer A merged migration 42 and developer B merged
+// migration 41 after 42 had already shipped: treating the max applied
+// version as a high-water mark (as filterMigrations does for the
+// legacy conversion) would silently assume 41 had run when it hadn't.
+func (s *SQLStore) PendingMigrations() ([]*models.Migration, error) {
+	embedded, err := getEmbeddedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := s.appliedMigrationVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	return computePendingMigrations(embedded, applied), nil
+}
+
+// computePendingMigrations is the pure comparison at the heart of
+// PendingMigrations, split out so it can be unit tested without a
+// database.
+func computePendingMigrations(embedded []*models.Migration, applied map[uint32]bool) []*models.Migration {
+	pending := []*models.Migration{}
+	for _, migration := range embedded {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending
+}
+
+// appliedMigrationVersions returns the set of every migration version
+// recorded in schema_migrations, rather than just the highest one.
+func (s *SQLStore) appliedMigrationVersions() (map[uint32]bool, error) {
+	query := s.getQueryBuilder(s.db).
+		Select("Version").
+		From(s.tablePrefix + "schema_migrations")
+
+	rows, err := query.Query()
+	if err != nil {
+		s.logger.Error("failed to fetch applied migration versions", mlog.Err(err))
+		return nil, err
+	}
+	defer s.CloseRows(rows)
+
+	applied := map[uint32]bool{}
+	for rows.Next() {
+		var version uint32
+		if err := rows.Scan(&version); err != nil {
+			s.logger.Error("failed to scan applied migration version", mlog.Err(err))
+			return nil, err
+		}
+		applied[version] = true
+	}
+
+	return applied, nil
+}
+
+// CheckMigrationGaps looks for pending migrations whose version is
+// below the highest applied version - i.e. gaps left by merges landing
+// out of order - and either refuses to boot (strict) or applies the
+// gap migrations itself, in ascending version order, before returning
+// (permissive, the default). It's called from EnsureSchemaMigrationFormat
+// with strict set to SQLStore.strictMigrationGaps, a config-driven field
+// so operators can tighten this to strict once their merge process
+// guarantees linear version history.
+func (s *SQLStore) CheckMigrationGaps(strict bool) error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	applied, err := s.appliedMigrationVersions()
+	if err != nil {
+		return err
+	}
+
+	maxApplied := maxAppliedVersion(applied)
+	gaps := computeMigrationGaps(pending, maxApplied)
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	for _, gap := range gaps {
+		s.logger.Warn("migration version is below the highest applied version but hasn't run",
+			mlog.Uint32("version", gap.Version), mlog.String("name", gap.Name), mlog.Uint32("highestApplied", maxApplied))
+	}
+
+	if strict {
+		return fmt.Errorf("%d migration(s) out of order were detected below the highest applied version (%d); refusing to boot in strict mode", len(gaps), maxApplied)
+	}
+
+	for _, gap := range gaps {
+		if err := s.applyMigration(gap); err != nil {
+			return fmt.Errorf("failed to apply out-of-order migration %d (%s): %w", gap.Version, gap.Name, err)
+		}
+		s.logger.Info("Applied out-of-order migration", mlog.Uint32("version", gap.Version), mlog.String("name", gap.Name))
+	}
+
+	return nil
+}
+
+// applyMigration executes the embedded up-migration SQL for migration
+// directly against the database and records it into schema_migrations,
+// for callers like CheckMigrationGaps that need to apply a specific
+// migration outside of the regular morph engine run. Like
+// applyMigrationPhase in migration_expand_contract.go, the DDL, the
+// bookkeeping insert and any registered migration callback all run in
+// one transaction, so a crash partway through can't leave
+// schema_migrations out of sync with the schema.
+func (s *SQLStore) applyMigration(migration *models.Migration) error {
+	script, err := readEmbeddedMigrationSQL(Assets, migration.Version)
+	if err != nil {
+		return err
+	}
+
+	alreadyApplied, err := s.migrationVersionApplied(migration.Version)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for migration %d: %w", migration.Version, err)
+	}
+
+	if err := s.runMigrationCallbacks(migration, tx, true, alreadyApplied); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(script); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to apply migration %d: %w", migration.Version, err)
+	}
+
+	insert := s.getQueryBuilder(s.db).
+		Insert(s.tablePrefix+"schema_migrations").
+		Columns("Version", "Name", "AppliedAt", "DurationMs", "Checksum", "Dirty").
+		Values(migration.Version, migration.Name, utils.GetMillis(), 0, migrationChecksum(script), false)
+
+	sqlStr, args, err := insert.ToSql()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(sqlStr, args...); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+	}
+
+	if err := s.runMigrationCallbacks(migration, tx, false, alreadyApplied); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", migration.Version, err)
+	}
+
+	return nil
+}
+
+// maxAppliedVersion returns the highest version present in applied, or
+// zero if applied is empty.
+func maxAppliedVersion(applied map[uint32]bool) uint32 {
+	var max uint32
+	for version := range applied {
+		if version > max {
+			max = version
+		}
+	}
+	return max
+}
+
+// computeMigrationGaps is the pure comparison at the heart of
+// CheckMigrationGaps, split out so it can be unit tested without a
+// database. It returns the subset of pending below maxApplied, sorted
+// ascending so callers that apply them can do so in order.
+func computeMigrationGaps(pending []*models.Migration, maxApplied uint32) []*models.Migration {
+	gaps := []*models.Migration{}
+	for _, migration := range pending {
+		if migration.Version < maxApplied {
+			gaps = append(gaps, migration)
+		}
+	}
+
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i].Version < gaps[j].Version })
+
+	return gaps
+}
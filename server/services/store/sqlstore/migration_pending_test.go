@@ -0,0 +1,64 @@
+package sqlstore
+
+import (
+	"testing"
+
+	"github.com/mattermost/morph/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputePendingMigrations(t *testing.T) {
+	embedded := []*models.Migration{
+		{Version: 1, Name: "one"},
+		{Version: 2, Name: "two"},
+		{Version: 3, Name: "three"},
+	}
+
+	t.Run("returns only the versions missing from applied", func(t *testing.T) {
+		applied := map[uint32]bool{1: true, 3: true}
+
+		pending := computePendingMigrations(embedded, applied)
+
+		require.Len(t, pending, 1)
+		require.EqualValues(t, 2, pending[0].Version)
+	})
+
+	t.Run("returns nothing when everything is applied", func(t *testing.T) {
+		applied := map[uint32]bool{1: true, 2: true, 3: true}
+
+		require.Empty(t, computePendingMigrations(embedded, applied))
+	})
+
+	t.Run("returns everything when nothing is applied", func(t *testing.T) {
+		require.Len(t, computePendingMigrations(embedded, map[uint32]bool{}), 3)
+	})
+}
+
+func TestMaxAppliedVersion(t *testing.T) {
+	require.EqualValues(t, 0, maxAppliedVersion(map[uint32]bool{}))
+	require.EqualValues(t, 5, maxAppliedVersion(map[uint32]bool{1: true, 5: true, 3: true}))
+}
+
+func TestComputeMigrationGaps(t *testing.T) {
+	t.Run("returns pending versions below the max, sorted ascending", func(t *testing.T) {
+		pending := []*models.Migration{
+			{Version: 5, Name: "five"},
+			{Version: 2, Name: "two"},
+		}
+
+		gaps := computeMigrationGaps(pending, 10)
+
+		require.Len(t, gaps, 2)
+		require.EqualValues(t, 2, gaps[0].Version)
+		require.EqualValues(t, 5, gaps[1].Version)
+	})
+
+	t.Run("returns nothing when every pending version is at or above the max", func(t *testing.T) {
+		pending := []*models.Migration{
+			{Version: 11, Name: "eleven"},
+			{Version: 10, Name: "ten"},
+		}
+
+		require.Empty(t, computeMigrationGaps(pending, 10))
+	})
+}
@@ -0,0 +1,131 @@
+package sqlstore
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"io/fs"
+
+	"github.com/mattermost/mattermost-server/v6/shared/mlog"
+	"github.com/mattermost/morph/models"
+)
+
+// MigrationScope bundles everything EnsureSchemaMigrationFormat and
+// its helpers need to operate on one logical database, so the same
+// SQLStore can drive more than one independent migration stream (e.g.
+// a hot operational store for blocks/sessions and a cold
+// telemetry/logs store) instead of every helper reaching into fields
+// hung directly off SQLStore.
+//
+// DefaultMigrationScope returns the scope matching SQLStore's own
+// historic behavior, so existing single-database callers don't need
+// to change.
+type MigrationScope struct {
+	// Prefix is the table prefix this scope's schema_migrations table
+	// and state tables live under, analogous to SQLStore.tablePrefix
+	// but independent of it.
+	Prefix string
+	// AssetsFS is the embedded migrations directory for this scope.
+	AssetsFS fs.FS
+	// DBHandle is the connection pool this scope's tables live in.
+	// Distinct scopes may point at entirely different databases (e.g.
+	// a separate SQLite file or Postgres schema for audit logs).
+	DBHandle *sql.DB
+	// DBType is the engine DBHandle actually talks to (e.g.
+	// model.SqliteDBType), which may differ from the default
+	// SQLStore's own dbType. It's what lets a scope split onto a
+	// different engine (e.g. a SQLite side file next to a Postgres
+	// main store) introspect and migrate itself correctly instead of
+	// assuming the default store's engine.
+	DBType string
+}
+
+// DefaultMigrationScope returns the MigrationScope equivalent to the
+// store's own table prefix, embedded assets, connection pool and
+// engine, i.e. the single-database behavior the rest of this package
+// implemented before MigrationScope was introduced.
+func (s *SQLStore) DefaultMigrationScope() MigrationScope {
+	return MigrationScope{
+		Prefix:   s.tablePrefix,
+		AssetsFS: Assets,
+		DBHandle: s.db,
+		DBType:   s.dbType,
+	}
+}
+
+// getEmbeddedMigrationsForScope is the MigrationScope-parameterized
+// equivalent of getEmbeddedMigrations, reading from scope.AssetsFS
+// rather than always from the package-level Assets.
+func getEmbeddedMigrationsForScope(scope MigrationScope) ([]*models.Migration, error) {
+	assetsList, err := fs.ReadDir(scope.AssetsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []*models.Migration{}
+	for _, f := range assetsList {
+		m, err := models.NewMigration(io.NopCloser(&bytes.Buffer{}), f.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if m.Direction != models.Up {
+			continue
+		}
+
+		migrations = append(migrations, m)
+	}
+
+	return migrations, nil
+}
+
+// EnsureSchemaMigrationFormatForScope is the MigrationScope-aware
+// equivalent of EnsureSchemaMigrationFormat, letting the store run the
+// legacy-format conversion independently against any of its logical
+// databases rather than only the one backing SQLStore's own fields.
+// It's built entirely out of the *In helpers next to each original
+// function (schemaObjectExistsIn, getLegacySchemaVersionIn,
+// createTempSchemaTableIn, populateTempSchemaTableIn,
+// useNewSchemaTableIn), parameterized by scope.DBType rather than
+// SQLStore's own dbType, so none of SQLStore's own db/tablePrefix/
+// dbType fields are read or mutated.
+func (s *SQLStore) EnsureSchemaMigrationFormatForScope(scope MigrationScope) error {
+	migrationNeeded, err := s.schemaObjectExistsIn(scope.DBHandle, scope.Prefix, scope.DBType, SchemaObjectColumn, "schema_migrations", "dirty")
+	if err != nil {
+		return err
+	}
+
+	if !migrationNeeded {
+		return nil
+	}
+
+	s.logger.Info("Migrating schema migration to new format", mlog.String("scope", scope.Prefix))
+
+	legacySchemaVersion, err := s.getLegacySchemaVersionIn(scope.DBHandle, scope.Prefix)
+	if err != nil {
+		return err
+	}
+
+	migrations, err := getEmbeddedMigrationsForScope(scope)
+	if err != nil {
+		return err
+	}
+	filteredMigrations := filterMigrations(migrations, legacySchemaVersion)
+
+	if err := s.createTempSchemaTableIn(scope.DBHandle, scope.Prefix); err != nil {
+		return err
+	}
+
+	s.logger.Info("Populating the temporal schema table",
+		mlog.String("scope", scope.Prefix), mlog.Uint32("legacySchemaVersion", legacySchemaVersion), mlog.Int("migrations", len(filteredMigrations)))
+
+	if err := s.populateTempSchemaTableIn(scope.DBHandle, scope.Prefix, scope.AssetsFS, filteredMigrations); err != nil {
+		return err
+	}
+
+	if err := s.useNewSchemaTableIn(scope.DBHandle, scope.Prefix, scope.DBType); err != nil {
+		return err
+	}
+
+	return nil
+}
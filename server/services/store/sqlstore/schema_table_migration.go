@@ -2,56 +2,70 @@ package sqlstore
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
+	"strings"
 
-	sq "github.com/Masterminds/squirrel"
 	"github.com/mattermost/focalboard/server/model"
+	"github.com/mattermost/focalboard/server/utils"
 	"github.com/mattermost/mattermost-server/v6/shared/mlog"
 	"github.com/mattermost/morph/models"
 )
 
 // EnsureSchemaMigrationFormat checks the schema migrations table
 // format and, if it's not using the new shape, it migrates the old
-// one's status before initializing the migrations engine.
+// one's status before initializing the migrations engine. It then
+// checks for out-of-order migration gaps via CheckMigrationGaps, since
+// this is the one place every boot path already calls before handing
+// off to the morph engine.
+//
+// This only backfills AppliedAt/DurationMs/Checksum/Dirty for
+// migrations that ran before the new format existed. The regular morph
+// engine run's own write to schema_migrations still only sets Version
+// and Name; whatever drives that engine MUST call
+// RecordMigrationForensics (migration_history.go) right after applying
+// each migration, or MigrationHistory will show zero/empty values for
+// every row recorded from here on.
 func (s *SQLStore) EnsureSchemaMigrationFormat() error {
 	migrationNeeded, err := s.isSchemaMigrationNeeded()
 	if err != nil {
 		return err
 	}
 
-	if !migrationNeeded {
-		return nil
-	}
-
-	s.logger.Info("Migrating schema migration to new format")
+	if migrationNeeded {
+		s.logger.Info("Migrating schema migration to new format")
 
-	legacySchemaVersion, err := s.getLegacySchemaVersion()
-	if err != nil {
-		return err
-	}
+		legacySchemaVersion, err := s.getLegacySchemaVersion()
+		if err != nil {
+			return err
+		}
 
-	migrations, err := getEmbeddedMigrations()
-	if err != nil {
-		return err
-	}
-	filteredMigrations := filterMigrations(migrations, legacySchemaVersion)
+		migrations, err := getEmbeddedMigrations()
+		if err != nil {
+			return err
+		}
+		filteredMigrations := filterMigrations(migrations, legacySchemaVersion)
 
-	if err := s.createTempSchemaTable(); err != nil {
-		return err
-	}
+		if err := s.createTempSchemaTableIn(s.db, s.tablePrefix); err != nil {
+			return err
+		}
 
-	s.logger.Info("Populating the temporal schema table", mlog.Uint32("legacySchemaVersion", legacySchemaVersion), mlog.Int("migrations", len(filteredMigrations)))
+		s.logger.Info("Populating the temporal schema table", mlog.Uint32("legacySchemaVersion", legacySchemaVersion), mlog.Int("migrations", len(filteredMigrations)))
 
-	if err := s.populateTempSchemaTable(filteredMigrations); err != nil {
-		return err
-	}
+		if err := s.populateTempSchemaTableIn(s.db, s.tablePrefix, Assets, filteredMigrations); err != nil {
+			return err
+		}
 
-	if err := s.useNewSchemaTable(); err != nil {
-		return err
+		if err := s.useNewSchemaTableIn(s.db, s.tablePrefix, s.dbType); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return s.CheckMigrationGaps(s.strictMigrationGaps)
 }
 
 // getEmbeddedMigrations returns a list of the embedded migrations
@@ -107,87 +121,20 @@ func filterMigrations(migrations []*models.Migration, legacySchemaVersion uint32
 func (s *SQLStore) isSchemaMigrationNeeded() (bool, error) {
 	// Check if `dirty` column exists on schema version table.
 	// This column exists only for the old schema version table.
-
-	// SQLite needs a bit of a special handling
-	if s.dbType == model.SqliteDBType {
-		return s.isSchemaMigrationNeededSQLite()
-	}
-
-	query := s.getQueryBuilder(s.db).
-		Select("count(*)").
-		From("information_schema.COLUMNS").
-		Where(sq.Eq{
-			"TABLE_NAME":  s.tablePrefix + "schema_migrations",
-			"COLUMN_NAME": "dirty",
-		})
-
-	switch s.dbType {
-	case model.MysqlDBType:
-		query = query.Where(sq.Eq{"TABLE_SCHEMA": s.schemaName})
-	case model.PostgresDBType:
-		query = query.Where(sq.Eq{"TABLE_SCHEMA": "current_schema()"})
-	}
-
-	row := query.QueryRow()
-
-	var count int
-	if err := row.Scan(&count); err != nil {
-		s.logger.Error("failed to check for columns of schema_migrations table", mlog.Err(err))
-		return false, err
-	}
-
-	return count == 1, nil
+	return s.SchemaObjectExists(SchemaObjectColumn, "schema_migrations", "dirty")
 }
 
-func (s *SQLStore) isSchemaMigrationNeededSQLite() (bool, error) {
-	// the way to check presence of a column is different
-	// for SQLite. Hence, the separate function
-
-	query := fmt.Sprintf("PRAGMA table_info(\"%sschema_migrations\");", s.tablePrefix)
-	rows, err := s.db.Query(query)
-	if err != nil {
-		s.logger.Error("SQLite - failed to check for columns in schema_migrations table", mlog.Err(err))
-		return false, err
-	}
-
-	defer s.CloseRows(rows)
-
-	data := [][]*string{}
-	for rows.Next() {
-		// PRAGMA returns 6 columns
-		row := make([]*string, 6)
-
-		err := rows.Scan(
-			&row[0],
-			&row[1],
-			&row[2],
-			&row[3],
-			&row[4],
-			&row[5],
-		)
-		if err != nil {
-			s.logger.Error("error scanning rows from SQLite schema_migrations table definition", mlog.Err(err))
-			return false, err
-		}
-
-		data = append(data, row)
-	}
-
-	nameColumnFound := false
-	for _, row := range data {
-		if len(row) >= 2 && *row[1] == "dirty" {
-			nameColumnFound = true
-			break
-		}
-	}
-
-	return nameColumnFound, nil
+func (s *SQLStore) getLegacySchemaVersion() (uint32, error) {
+	return s.getLegacySchemaVersionIn(s.db, s.tablePrefix)
 }
 
-func (s *SQLStore) getLegacySchemaVersion() (uint32, error) {
-	query := s.getQueryBuilder(s.db).
+// getLegacySchemaVersionIn is getLegacySchemaVersion parameterized by
+// the connection and table prefix to read from, for the same reason
+// as schemaObjectExistsIn in schema_object_exists.go.
+func (s *SQLStore) getLegacySchemaVersionIn(db *sql.DB, tablePrefix string) (uint32, error) {
+	query := s.getQueryBuilder(db).
 		Select("version").
-		From(s.tablePrefix + "schema_migrations")
+		From(tablePrefix + "schema_migrations")
 
 	row := query.QueryRow()
 
@@ -200,70 +147,143 @@ func (s *SQLStore) getLegacySchemaVersion() (uint32, error) {
 	return version, nil
 }
 
-func (s *SQLStore) createTempSchemaTable() error {
+// createTempSchemaTableIn is createTempSchemaTable parameterized by
+// the connection and table prefix to create the table in, for the
+// same reason as schemaObjectExistsIn in schema_object_exists.go.
+//
+// AppliedAt, DurationMs, Checksum and Dirty are not read from the
+// legacy table, which has no such data; populateTempSchemaTableIn
+// backfills best-effort values for them so that MigrationHistory has
+// forensic data to show for migrations that ran before this table
+// existed.
+func (s *SQLStore) createTempSchemaTableIn(db *sql.DB, tablePrefix string) error {
 	// squirrel doesn't support DDL query in query builder
 	// so, we need to use a plain old string
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (Version bigint NOT NULL, Name varchar(64) NOT NULL, PRIMARY KEY (Version))", s.tablePrefix+tempSchemaMigrationTableName)
-	if _, err := s.db.Exec(query); err != nil {
-		s.logger.Error("failed to create temporary schema migration table", mlog.Err(err))
-		s.logger.Error("createTempSchemaTable error  " + err.Error())
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (Version bigint NOT NULL, Name varchar(64) NOT NULL, AppliedAt bigint NOT NULL DEFAULT 0, DurationMs bigint NOT NULL DEFAULT 0, Checksum varchar(64) NOT NULL DEFAULT '', Dirty boolean NOT NULL DEFAULT false, PRIMARY KEY (Version))", tablePrefix+tempSchemaMigrationTableName)
+	if _, err := db.Exec(query); err != nil {
+		s.logger.Error("failed to create temporary schema migration table", mlog.String("prefix", tablePrefix), mlog.Err(err))
 		return err
 	}
 
 	return nil
 }
 
-func (s *SQLStore) populateTempSchemaTable(migrations []*models.Migration) error {
-	query := s.getQueryBuilder(s.db).
-		Insert(s.tablePrefix+tempSchemaMigrationTableName).
-		Columns("Version", "Name")
+func (s *SQLStore) createTempSchemaTable() error {
+	return s.createTempSchemaTableIn(s.db, s.tablePrefix)
+}
+
+// populateTempSchemaTableIn is populateTempSchemaTable parameterized
+// by the connection, table prefix and embedded migrations filesystem
+// to read from, for the same reason as schemaObjectExistsIn in
+// schema_object_exists.go.
+func (s *SQLStore) populateTempSchemaTableIn(db *sql.DB, tablePrefix string, assetsFS fs.FS, migrations []*models.Migration) error {
+	query := s.getQueryBuilder(db).
+		Insert(tablePrefix+tempSchemaMigrationTableName).
+		Columns("Version", "Name", "AppliedAt", "DurationMs", "Checksum", "Dirty")
 
+	appliedAt := utils.GetMillis()
 	for _, migration := range migrations {
 		s.logger.Info("-- Registering migration", mlog.Uint32("version", migration.Version), mlog.String("name", migration.Name))
-		query = query.Values(migration.Version, migration.Name)
+
+		// we don't know when these historic migrations actually ran
+		// or how long they took, so AppliedAt is backfilled to the
+		// time of this one-shot conversion and DurationMs is left at
+		// zero. Checksum is hashed from the migration's actual SQL
+		// script, not just its name, so it's meaningful to compare
+		// against FetchMigrationScript later to detect drift between
+		// what ran and what the current binary would apply now.
+		script, err := readEmbeddedMigrationSQL(assetsFS, migration.Version)
+		if err != nil {
+			return err
+		}
+
+		query = query.Values(migration.Version, migration.Name, appliedAt, 0, migrationChecksum(script), false)
 	}
 
 	if _, err := query.Exec(); err != nil {
-		s.logger.Error("failed to insert migration records into temporary schema table", mlog.Err(err))
+		s.logger.Error("failed to insert migration records into temporary schema table", mlog.String("prefix", tablePrefix), mlog.Err(err))
 		return err
 	}
 
 	return nil
 }
 
-func (s *SQLStore) useNewSchemaTable() error {
+func (s *SQLStore) populateTempSchemaTable(migrations []*models.Migration) error {
+	return s.populateTempSchemaTableIn(s.db, s.tablePrefix, Assets, migrations)
+}
+
+// migrationChecksum returns a short, stable checksum of a migration's
+// SQL script, used both to backfill Checksum when converting legacy
+// installs and to record it for migrations applied afterwards.
+func migrationChecksum(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// readEmbeddedMigrationSQL finds the embedded up-migration asset for
+// version in assetsFS and returns its contents, for computing a
+// Checksum or serving FetchMigrationScript.
+func readEmbeddedMigrationSQL(assetsFS fs.FS, version uint32) (string, error) {
+	assetsList, err := fs.ReadDir(assetsFS, "migrations")
+	if err != nil {
+		return "", err
+	}
+
+	prefix := fmt.Sprintf("%06d_", version)
+	for _, f := range assetsList {
+		name := f.Name()
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".up.sql") {
+			data, err := fs.ReadFile(assetsFS, "migrations/"+name)
+			if err != nil {
+				return "", err
+			}
+			return string(data), nil
+		}
+	}
+
+	return "", fmt.Errorf("no embedded migration found for version %d", version)
+}
+
+// useNewSchemaTableIn is useNewSchemaTable parameterized by the
+// connection, table prefix and engine to operate on, for the same
+// reason as schemaObjectExistsIn in schema_object_exists.go.
+func (s *SQLStore) useNewSchemaTableIn(db *sql.DB, tablePrefix string, dbType string) error {
 	// first delete the old table, then
 	// rename the new table to old table's name
 
 	// renaming old schema migration table. Will delete later once the migration is
 	// complete, just in case.
 	var query string
-	if s.dbType == model.MysqlDBType {
-		query = fmt.Sprintf("RENAME TABLE `%sschema_migrations` TO `%sschema_migrations_old_temp`", s.tablePrefix, s.tablePrefix)
+	if dbType == model.MysqlDBType {
+		query = fmt.Sprintf("RENAME TABLE `%sschema_migrations` TO `%sschema_migrations_old_temp`", tablePrefix, tablePrefix)
 	} else {
-		query = fmt.Sprintf("ALTER TABLE %sschema_migrations RENAME TO %sschema_migrations_old_temp", s.tablePrefix, s.tablePrefix)
+		query = fmt.Sprintf("ALTER TABLE %sschema_migrations RENAME TO %sschema_migrations_old_temp", tablePrefix, tablePrefix)
 	}
 
-	if _, err := s.db.Exec(query); err != nil {
-		s.logger.Error("failed to rename old schema migration table", mlog.Err(err))
+	if _, err := db.Exec(query); err != nil {
+		s.logger.Error("failed to rename old schema migration table", mlog.String("prefix", tablePrefix), mlog.Err(err))
 		return err
 	}
 
 	// renaming new temp table to old table's name
-	if s.dbType == model.MysqlDBType {
-		query = fmt.Sprintf("RENAME TABLE `%s%s` TO `%sschema_migrations`", s.tablePrefix, tempSchemaMigrationTableName, s.tablePrefix)
+	if dbType == model.MysqlDBType {
+		query = fmt.Sprintf("RENAME TABLE `%s%s` TO `%sschema_migrations`", tablePrefix, tempSchemaMigrationTableName, tablePrefix)
 	} else {
-		query = fmt.Sprintf("ALTER TABLE %s%s RENAME TO %sschema_migrations", s.tablePrefix, tempSchemaMigrationTableName, s.tablePrefix)
+		query = fmt.Sprintf("ALTER TABLE %s%s RENAME TO %sschema_migrations", tablePrefix, tempSchemaMigrationTableName, tablePrefix)
 	}
 
-	if _, err := s.db.Exec(query); err != nil {
-		s.logger.Error("failed to rename temp schema table", mlog.Err(err))
+	if _, err := db.Exec(query); err != nil {
+		s.logger.Error("failed to rename temp schema table", mlog.String("prefix", tablePrefix), mlog.Err(err))
 		return err
 	}
 
 	return nil
 }
 
+func (s *SQLStore) useNewSchemaTable() error {
+	return s.useNewSchemaTableIn(s.db, s.tablePrefix, s.dbType)
+}
+
 func (s *SQLStore) deleteOldSchemaMigrationTable() error {
 	query := "DROP TABLE IF EXISTS " + s.tablePrefix + "schema_migrations_old_temp"
 	if _, err := s.db.Exec(query); err != nil {
@@ -0,0 +1,32 @@
+package sqlstore
+
+import (
+	"testing"
+
+	"github.com/mattermost/morph/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationChecksum(t *testing.T) {
+	a := migrationChecksum("CREATE TABLE foo (id int);")
+	b := migrationChecksum("CREATE TABLE foo (id int);")
+	c := migrationChecksum("CREATE TABLE bar (id int);")
+
+	require.Equal(t, a, b)
+	require.NotEqual(t, a, c)
+}
+
+func TestFilterMigrations(t *testing.T) {
+	migrations := []*models.Migration{
+		{Version: 1, Name: "one", Direction: models.Up},
+		{Version: 2, Name: "two", Direction: models.Up},
+		{Version: 2, Name: "two", Direction: models.Down},
+		{Version: 3, Name: "three", Direction: models.Up},
+	}
+
+	filtered := filterMigrations(migrations, 2)
+
+	require.Len(t, filtered, 2)
+	require.EqualValues(t, 1, filtered[0].Version)
+	require.EqualValues(t, 2, filtered[1].Version)
+}